@@ -0,0 +1,35 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package connection defines the subset of a CSI driver's Controller service
+// calls the attacher controller needs. It holds no gRPC client itself.
+package connection
+
+import (
+	"context"
+)
+
+// CSIConnection is the interface used by pkg/controller to talk to a CSI
+// driver. In this repository it is implemented only by the fakes used in
+// pkg/controller's tests.
+type CSIConnection interface {
+	// Attach issues ControllerPublishVolume for the given volume/node pair
+	// and returns the publish context reported by the driver, if any.
+	Attach(ctx context.Context, volumeHandle string, readOnly bool, nodeID string, volumeAttributes, secrets map[string]string) (metadata map[string]string, err error)
+
+	// Detach issues ControllerUnpublishVolume for the given volume/node pair.
+	Detach(ctx context.Context, volumeHandle string, nodeID string, secrets map[string]string) error
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package assumecache provides a small cache that lets a controller
+// optimistically "assume" the object it just wrote, so that a read
+// immediately afterwards sees that write even if the shared informer this
+// controller also reads from has not delivered the corresponding watch event
+// yet. This closes races where a controller would otherwise re-read stale
+// state and redo work (e.g. re-issue a CSI call) between writing an object
+// and its own informer catching up.
+package assumecache
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Object is the minimal interface an object must satisfy to be stored in an
+// AssumeCache.
+type Object interface {
+	GetName() string
+	GetResourceVersion() string
+}
+
+type assumedEntry struct {
+	obj       Object
+	version   int64
+	assumedAt time.Time
+}
+
+// AssumeCache remembers, per object name, the newest version of an object
+// this controller has itself written.
+type AssumeCache struct {
+	ttl time.Duration
+
+	mutex   sync.RWMutex
+	assumed map[string]assumedEntry
+}
+
+// NewAssumeCache creates an AssumeCache whose entries are evicted once they
+// are older than ttl, even if the informer never reports having caught up. A
+// ttl of 0 disables time-based eviction.
+func NewAssumeCache(ttl time.Duration) *AssumeCache {
+	return &AssumeCache{
+		ttl:     ttl,
+		assumed: make(map[string]assumedEntry),
+	}
+}
+
+// Assume stores obj as the newest known version of its name. It refuses to
+// overwrite an already-assumed entry with an equal or older resourceVersion.
+func (c *AssumeCache) Assume(obj Object) error {
+	version, err := parseResourceVersion(obj.GetResourceVersion())
+	if err != nil {
+		return fmt.Errorf("could not parse resourceVersion of %q: %s", obj.GetName(), err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if existing, ok := c.assumed[obj.GetName()]; ok && existing.version >= version {
+		return fmt.Errorf("could not assume %q: resourceVersion %d is not newer than already assumed %d", obj.GetName(), version, existing.version)
+	}
+
+	c.assumed[obj.GetName()] = assumedEntry{obj: obj, version: version, assumedAt: time.Now()}
+	return nil
+}
+
+// Restore drops the assumed entry for name, if any. It is used when a write
+// that would have been assumed turned out to fail, so the cache does not
+// keep serving an assumption nothing ever wrote.
+func (c *AssumeCache) Restore(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.assumed, name)
+}
+
+// GetNewest returns the assumed object for name, if this cache holds one
+// newer than observed (typically the version an informer most recently
+// delivered). The assumed entry is evicted, and GetNewest returns false, once
+// observed is at least as new as it, or once it has aged out past the
+// cache's ttl.
+func (c *AssumeCache) GetNewest(name string, observed Object) (Object, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.assumed[name]
+	if !ok {
+		return nil, false
+	}
+
+	if c.ttl > 0 && time.Since(entry.assumedAt) > c.ttl {
+		delete(c.assumed, name)
+		return nil, false
+	}
+
+	if observed != nil {
+		if observedVersion, err := parseResourceVersion(observed.GetResourceVersion()); err == nil && observedVersion >= entry.version {
+			// The informer (or this read) has caught up with what we assumed.
+			delete(c.assumed, name)
+			return nil, false
+		}
+	}
+
+	return entry.obj, true
+}
+
+func parseResourceVersion(rv string) (int64, error) {
+	if rv == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(rv, 10, 64)
+}
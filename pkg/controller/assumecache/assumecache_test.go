@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package assumecache
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeObject struct {
+	name            string
+	resourceVersion string
+}
+
+func (f fakeObject) GetName() string            { return f.name }
+func (f fakeObject) GetResourceVersion() string { return f.resourceVersion }
+
+func TestAssumeAndGetNewest(t *testing.T) {
+	c := NewAssumeCache(0)
+	if err := c.Assume(fakeObject{name: "a", resourceVersion: "1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, ok := c.GetNewest("a", fakeObject{name: "a", resourceVersion: "0"})
+	if !ok || got.GetResourceVersion() != "1" {
+		t.Errorf("expected assumed object with resourceVersion 1, got %+v, ok=%v", got, ok)
+	}
+}
+
+func TestAssumeRefusesDowngrade(t *testing.T) {
+	c := NewAssumeCache(0)
+	if err := c.Assume(fakeObject{name: "a", resourceVersion: "5"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := c.Assume(fakeObject{name: "a", resourceVersion: "3"}); err == nil {
+		t.Errorf("expected an error assuming an older resourceVersion")
+	}
+
+	got, ok := c.GetNewest("a", fakeObject{name: "a", resourceVersion: "0"})
+	if !ok || got.GetResourceVersion() != "5" {
+		t.Errorf("expected the newer assumed object to survive the rejected downgrade, got %+v, ok=%v", got, ok)
+	}
+}
+
+func TestGetNewestEvictsOnceObservedCatchesUp(t *testing.T) {
+	c := NewAssumeCache(0)
+	if err := c.Assume(fakeObject{name: "a", resourceVersion: "2"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, ok := c.GetNewest("a", fakeObject{name: "a", resourceVersion: "2"}); ok {
+		t.Errorf("expected the assumed entry to be evicted once observed caught up")
+	}
+	if _, ok := c.GetNewest("a", fakeObject{name: "a", resourceVersion: "2"}); ok {
+		t.Errorf("expected the entry to stay evicted")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	c := NewAssumeCache(0)
+	if err := c.Assume(fakeObject{name: "a", resourceVersion: "2"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Restore("a")
+
+	if _, ok := c.GetNewest("a", fakeObject{name: "a", resourceVersion: "0"}); ok {
+		t.Errorf("expected Restore to drop the assumed entry")
+	}
+}
+
+func TestGetNewestRespectsTTL(t *testing.T) {
+	c := NewAssumeCache(time.Millisecond)
+	if err := c.Assume(fakeObject{name: "a", resourceVersion: "2"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.GetNewest("a", fakeObject{name: "a", resourceVersion: "0"}); ok {
+		t.Errorf("expected the assumed entry to expire after its ttl")
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package attachlimiter throttles how many CSI ControllerPublishVolume and
+// ControllerUnpublishVolume calls the attacher issues at once, bounding both
+// the total in flight and how many target any single node. It exists
+// because an attach storm against a large cluster can otherwise send an
+// unbounded number of concurrent requests at a cloud provider's API.
+package attachlimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// waiter is a single blocked Acquire call.
+type waiter struct {
+	granted chan struct{}
+}
+
+// Limiter bounds concurrent CSI ControllerPublish/ControllerUnpublish calls
+// per node and overall, using the limits passed to NewLimiter; this package
+// defines no command-line flags for them. Requests queued for different nodes are
+// dispatched round-robin as capacity frees up, so a node with many queued
+// attaches cannot starve attaches queued against other nodes.
+type Limiter struct {
+	maxPerNode int
+	maxTotal   int
+
+	mu       sync.Mutex
+	inflight map[string]int
+	total    int
+	queues   map[string][]*waiter
+	order    []string // nodes with a non-empty queue, in round-robin order
+	next     int      // index into order of the next node dispatch will try
+
+	inflightGauge *prometheus.GaugeVec
+	queueDepth    *prometheus.GaugeVec
+	waitSeconds   *prometheus.HistogramVec
+}
+
+// NewLimiter creates a Limiter allowing at most maxAttachPerNode concurrent
+// CSI calls against any one node and maxAttachTotal concurrent CSI calls
+// overall. A limit of 0 means that bound is unenforced.
+func NewLimiter(maxAttachPerNode, maxAttachTotal int) *Limiter {
+	return &Limiter{
+		maxPerNode: maxAttachPerNode,
+		maxTotal:   maxAttachTotal,
+		inflight:   make(map[string]int),
+		queues:     make(map[string][]*waiter),
+
+		inflightGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "csi_attacher_inflight_attaches",
+			Help: "Number of ControllerPublishVolume/ControllerUnpublishVolume calls currently in flight for a node.",
+		}, []string{"node"}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "csi_attacher_attach_queue_depth",
+			Help: "Number of ControllerPublishVolume/ControllerUnpublishVolume calls currently queued for a node.",
+		}, []string{"node"}),
+		waitSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "csi_attacher_attach_queue_wait_seconds",
+			Help:    "Time an attach/detach call spent queued before being allowed to run.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"node"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	l.inflightGauge.Describe(ch)
+	l.queueDepth.Describe(ch)
+	l.waitSeconds.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.inflightGauge.Collect(ch)
+	l.queueDepth.Collect(ch)
+	l.waitSeconds.Collect(ch)
+}
+
+// Acquire blocks until a slot for node is available under both the
+// per-node and total limits, or until ctx is done. On success, the caller
+// must call Release(node) once it has finished the call the slot was held
+// for.
+func (l *Limiter) Acquire(ctx context.Context, node string) error {
+	start := time.Now()
+
+	l.mu.Lock()
+	if l.canRunLocked(node) {
+		l.grantLocked(node)
+		l.mu.Unlock()
+		l.waitSeconds.WithLabelValues(node).Observe(time.Since(start).Seconds())
+		return nil
+	}
+
+	w := &waiter{granted: make(chan struct{})}
+	l.enqueueLocked(node, w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		l.waitSeconds.WithLabelValues(node).Observe(time.Since(start).Seconds())
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.removeWaiterLocked(node, w)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot held by a prior successful Acquire(ctx, node) call
+// and lets the next queued request, if any, run.
+func (l *Limiter) Release(node string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight[node]--
+	l.total--
+	l.inflightGauge.WithLabelValues(node).Set(float64(l.inflight[node]))
+	l.dispatchLocked()
+}
+
+func (l *Limiter) canRunLocked(node string) bool {
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+	if l.maxPerNode > 0 && l.inflight[node] >= l.maxPerNode {
+		return false
+	}
+	return true
+}
+
+func (l *Limiter) grantLocked(node string) {
+	l.inflight[node]++
+	l.total++
+	l.inflightGauge.WithLabelValues(node).Set(float64(l.inflight[node]))
+}
+
+func (l *Limiter) enqueueLocked(node string, w *waiter) {
+	if _, ok := l.queues[node]; !ok {
+		l.order = append(l.order, node)
+	}
+	l.queues[node] = append(l.queues[node], w)
+	l.queueDepth.WithLabelValues(node).Set(float64(len(l.queues[node])))
+}
+
+func (l *Limiter) removeWaiterLocked(node string, w *waiter) {
+	q := l.queues[node]
+	for i, qw := range q {
+		if qw == w {
+			q = append(q[:i], q[i+1:]...)
+			break
+		}
+	}
+	if len(q) == 0 {
+		delete(l.queues, node)
+		l.removeFromOrderLocked(node)
+	} else {
+		l.queues[node] = q
+	}
+	l.queueDepth.WithLabelValues(node).Set(float64(len(q)))
+}
+
+func (l *Limiter) removeFromOrderLocked(node string) {
+	for i, n := range l.order {
+		if n == node {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			if l.next > i {
+				l.next--
+			}
+			break
+		}
+	}
+	if len(l.order) > 0 {
+		l.next %= len(l.order)
+	} else {
+		l.next = 0
+	}
+}
+
+// dispatchLocked grants as many queued waiters as current capacity allows,
+// visiting nodes round-robin so that a node with a long queue cannot
+// monopolize the global budget.
+func (l *Limiter) dispatchLocked() {
+	if len(l.order) == 0 {
+		return
+	}
+
+	attempts := 0
+	for attempts < len(l.order) {
+		if l.maxTotal > 0 && l.total >= l.maxTotal {
+			return
+		}
+
+		node := l.order[l.next]
+		q := l.queues[node]
+		if len(q) > 0 && (l.maxPerNode == 0 || l.inflight[node] < l.maxPerNode) {
+			w := q[0]
+			l.queues[node] = q[1:]
+			l.queueDepth.WithLabelValues(node).Set(float64(len(l.queues[node])))
+			l.grantLocked(node)
+			close(w.granted)
+
+			if len(l.queues[node]) == 0 {
+				l.removeFromOrderLocked(node)
+				attempts = 0
+				continue
+			}
+		}
+
+		l.next = (l.next + 1) % len(l.order)
+		attempts++
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package attachlimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterEnforcesPerNodeCap(t *testing.T) {
+	l := NewLimiter(1, 0)
+	ctx := context.Background()
+
+	if err := l.Acquire(ctx, "node1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		_ = l.Acquire(ctx, "node1")
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("second Acquire for node1 should have blocked behind the per-node cap")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.Release("node1")
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("second Acquire for node1 should have been granted after Release")
+	}
+}
+
+func TestLimiterEnforcesTotalCap(t *testing.T) {
+	l := NewLimiter(0, 1)
+	ctx := context.Background()
+
+	if err := l.Acquire(ctx, "node1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		_ = l.Acquire(ctx, "node2")
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Acquire for node2 should have blocked behind the total cap")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.Release("node1")
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("Acquire for node2 should have been granted after node1's slot was released")
+	}
+}
+
+func TestLimiterDispatchesQueuedNodesRoundRobin(t *testing.T) {
+	l := NewLimiter(0, 1)
+	ctx := context.Background()
+
+	if err := l.Acquire(ctx, "busy"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Queue two requests for "busy" before a single request for "quiet".
+	// Round-robin dispatch must not let "busy" starve "quiet" out of its
+	// turn once the global slot frees up enough times for both to run.
+	order := make(chan string, 3)
+	release := func(node string) {
+		if err := l.Acquire(ctx, node); err != nil {
+			t.Errorf("unexpected error acquiring for %s: %s", node, err)
+			return
+		}
+		order <- node
+	}
+	go release("busy")
+	go release("busy")
+	go release("quiet")
+
+	time.Sleep(50 * time.Millisecond) // let all three enqueue behind the held slot
+	l.Release("busy")                 // frees the slot "busy" held before queuing
+
+	first := <-order
+	l.Release(first)
+	second := <-order
+	l.Release(second)
+	third := <-order
+	l.Release(third)
+
+	if third == "quiet" {
+		t.Errorf("expected quiet's request to be interleaved with busy's, got order %s, %s, %s", first, second, third)
+	}
+}
+
+func TestLimiterAcquireRespectsContextCancellation(t *testing.T) {
+	l := NewLimiter(1, 0)
+	ctx := context.Background()
+	if err := l.Acquire(ctx, "node1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Acquire(cancelCtx, "node1")
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected Acquire to return an error once its context was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Acquire did not return after its context was cancelled")
+	}
+
+	// The cancelled waiter must have been dequeued: releasing node1's
+	// original slot should not leave anything stuck waiting on it.
+	l.Release("node1")
+	if err := l.Acquire(ctx, "node1"); err != nil {
+		t.Fatalf("unexpected error re-acquiring node1 after the cancelled waiter cleared: %s", err)
+	}
+}
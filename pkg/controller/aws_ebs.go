@@ -0,0 +1,57 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+)
+
+// awsEBSCSIDriverName is the CSI driver that AWS EBS migrates to.
+const awsEBSCSIDriverName = "ebs.csi.aws.com"
+
+func init() {
+	registerInTreePlugin(&awsElasticBlockStorePlugin{})
+}
+
+type awsElasticBlockStorePlugin struct{}
+
+func (p *awsElasticBlockStorePlugin) CanSupport(pv *v1.PersistentVolume) bool {
+	return pv.Spec.AWSElasticBlockStore != nil
+}
+
+func (p *awsElasticBlockStorePlugin) GetCSIDriverName() string {
+	return awsEBSCSIDriverName
+}
+
+func (p *awsElasticBlockStorePlugin) TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.CSIPersistentVolumeSource, error) {
+	ebs := pv.Spec.AWSElasticBlockStore
+	if ebs == nil {
+		return nil, fmt.Errorf("PersistentVolume %q does not have an AWSElasticBlockStore source", pv.Name)
+	}
+	if ebs.Partition != 0 {
+		return nil, fmt.Errorf("AWSElasticBlockStore %q: partitions are not supported by the migrated CSI driver", ebs.VolumeID)
+	}
+
+	return &v1.CSIPersistentVolumeSource{
+		Driver:       awsEBSCSIDriverName,
+		VolumeHandle: ebs.VolumeID,
+		ReadOnly:     ebs.ReadOnly,
+		FSType:       ebs.FSType,
+	}, nil
+}
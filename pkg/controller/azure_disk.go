@@ -0,0 +1,66 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+)
+
+// azureDiskCSIDriverName is the CSI driver that Azure Disk migrates to.
+const azureDiskCSIDriverName = "disk.csi.azure.com"
+
+func init() {
+	registerInTreePlugin(&azureDiskPlugin{})
+}
+
+type azureDiskPlugin struct{}
+
+func (p *azureDiskPlugin) CanSupport(pv *v1.PersistentVolume) bool {
+	return pv.Spec.AzureDisk != nil
+}
+
+func (p *azureDiskPlugin) GetCSIDriverName() string {
+	return azureDiskCSIDriverName
+}
+
+func (p *azureDiskPlugin) TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.CSIPersistentVolumeSource, error) {
+	disk := pv.Spec.AzureDisk
+	if disk == nil {
+		return nil, fmt.Errorf("PersistentVolume %q does not have an AzureDisk source", pv.Name)
+	}
+
+	readOnly := false
+	if disk.ReadOnly != nil {
+		readOnly = *disk.ReadOnly
+	}
+	fsType := ""
+	if disk.FSType != nil {
+		fsType = *disk.FSType
+	}
+
+	return &v1.CSIPersistentVolumeSource{
+		Driver:       azureDiskCSIDriverName,
+		VolumeHandle: disk.DataDiskURI,
+		ReadOnly:     readOnly,
+		FSType:       fsType,
+		VolumeAttributes: map[string]string{
+			"diskname": disk.DiskName,
+		},
+	}, nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+)
+
+// cinderCSIDriverName is the CSI driver that OpenStack Cinder migrates to.
+const cinderCSIDriverName = "cinder.csi.openstack.org"
+
+func init() {
+	registerInTreePlugin(&cinderVolumePlugin{})
+}
+
+type cinderVolumePlugin struct{}
+
+func (p *cinderVolumePlugin) CanSupport(pv *v1.PersistentVolume) bool {
+	return pv.Spec.Cinder != nil
+}
+
+func (p *cinderVolumePlugin) GetCSIDriverName() string {
+	return cinderCSIDriverName
+}
+
+func (p *cinderVolumePlugin) TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.CSIPersistentVolumeSource, error) {
+	cinder := pv.Spec.Cinder
+	if cinder == nil {
+		return nil, fmt.Errorf("PersistentVolume %q does not have a Cinder source", pv.Name)
+	}
+
+	return &v1.CSIPersistentVolumeSource{
+		Driver:       cinderCSIDriverName,
+		VolumeHandle: cinder.VolumeID,
+		ReadOnly:     cinder.ReadOnly,
+		FSType:       cinder.FSType,
+	}, nil
+}
@@ -0,0 +1,495 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package controller implements the reconciliation loop that drives
+// VolumeAttachment objects towards the CSI ControllerPublish/Unpublish state
+// reported by the driver named by attacherName.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kubernetes-csi/external-attacher-csi/pkg/connection"
+	"github.com/kubernetes-csi/external-attacher-csi/pkg/controller/assumecache"
+	"github.com/kubernetes-csi/external-attacher-csi/pkg/controller/attachlimiter"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+)
+
+// finalizerPrefix is prepended to the CSI driver name to build the
+// VolumeAttachment/PersistentVolume finalizer this attacher owns.
+const finalizerPrefix = "attacher-"
+
+// vaAssumeCacheTTL bounds how long a VolumeAttachment write is trusted over
+// whatever the informer reports, in case an assumed object's watch event is
+// lost entirely.
+const vaAssumeCacheTTL = 30 * time.Second
+
+// Handler reacts to VolumeAttachment and PersistentVolume events, driving
+// them towards the CSI ControllerPublish/Unpublish state reported by the
+// driver.
+type Handler interface {
+	// SyncNewOrUpdatedVolumeAttachment is called for VolumeAttachment add and
+	// update events. It attaches or detaches the volume depending on the
+	// object's DeletionTimestamp and Status.Attached.
+	SyncNewOrUpdatedVolumeAttachment(va *storagev1.VolumeAttachment)
+
+	// SyncNewOrUpdatedPersistentVolume is called for PersistentVolume add and
+	// update events. It removes this attacher's finalizer once the PV is
+	// marked for deletion and no VolumeAttachment references it anymore.
+	SyncNewOrUpdatedPersistentVolume(pv *v1.PersistentVolume)
+
+	// DeleteVolumeAttachment is called when a VolumeAttachment is removed. It
+	// removes this attacher's finalizer from the referenced PersistentVolume
+	// once that PV is marked for deletion and no other VolumeAttachment still
+	// references it.
+	DeleteVolumeAttachment(va *storagev1.VolumeAttachment)
+}
+
+type csiHandler struct {
+	client           kubernetes.Interface
+	attacherName     string
+	csiConnection    connection.CSIConnection
+	pvLister         corelisters.PersistentVolumeLister
+	nodeLister       corelisters.NodeLister
+	vaLister         storagelisters.VolumeAttachmentLister
+	secretLister     corelisters.SecretLister
+	vaCache          *assumecache.AssumeCache
+	limiter          *attachlimiter.Limiter
+	migrationEnabled bool
+}
+
+// NewCSIHandler creates a Handler that drives VolumeAttachments referencing
+// attacherName. limiter, built by the caller with attachlimiter.NewLimiter,
+// bounds how many ControllerPublish/Unpublish calls this handler has in
+// flight at once; pass nil for no limit. No command-line flags set it.
+// migrationEnabled gates in-tree volume translation for attacherName: it
+// reflects the operator's CSI Migration feature gate for this specific
+// driver (e.g. CSIMigrationGCE), so a PV using the in-tree source this
+// migration covers is only translated and attached through CSI when true.
+func NewCSIHandler(
+	client kubernetes.Interface,
+	attacherName string,
+	csiConnection connection.CSIConnection,
+	pvLister corelisters.PersistentVolumeLister,
+	nodeLister corelisters.NodeLister,
+	vaLister storagelisters.VolumeAttachmentLister,
+	secretLister corelisters.SecretLister,
+	limiter *attachlimiter.Limiter,
+	migrationEnabled bool,
+) Handler {
+	return &csiHandler{
+		client:           client,
+		attacherName:     attacherName,
+		csiConnection:    csiConnection,
+		pvLister:         pvLister,
+		nodeLister:       nodeLister,
+		vaLister:         vaLister,
+		secretLister:     secretLister,
+		vaCache:          assumecache.NewAssumeCache(vaAssumeCacheTTL),
+		limiter:          limiter,
+		migrationEnabled: migrationEnabled,
+	}
+}
+
+func (h *csiHandler) finalizerName() string {
+	return finalizerPrefix + h.attacherName
+}
+
+func (h *csiHandler) SyncNewOrUpdatedVolumeAttachment(va *storagev1.VolumeAttachment) {
+	// If this controller wrote a newer version of va than the one the
+	// informer just delivered, use that instead: the informer event may be
+	// the stale one that triggered our own last write, re-delivered before
+	// its watch has caught up.
+	if newer, ok := h.vaCache.GetNewest(va.Name, va); ok {
+		va = newer.(*storagev1.VolumeAttachment)
+	}
+
+	if va.Spec.Attacher != h.attacherName {
+		return
+	}
+
+	if va.DeletionTimestamp != nil {
+		h.syncDetach(va)
+		return
+	}
+
+	if va.Status.Attached {
+		return
+	}
+
+	h.syncAttach(va)
+}
+
+func (h *csiHandler) syncAttach(va *storagev1.VolumeAttachment) {
+	va, err := h.addVAFinalizer(va)
+	if err != nil {
+		h.saveAttachError(va, fmt.Errorf("could not add VolumeAttachment finalizer: %s", err))
+		return
+	}
+
+	pv, err := h.getPV(va)
+	if err != nil {
+		h.saveAttachError(va, err)
+		return
+	}
+	if pv.DeletionTimestamp != nil {
+		h.saveAttachError(va, fmt.Errorf("PersistentVolume %q is marked for deletion", pv.Name))
+		return
+	}
+
+	csiSource, err := h.csiSourceForPV(pv)
+	if err != nil {
+		h.saveAttachError(va, err)
+		return
+	}
+	if csiSource == nil {
+		// This PV is not handled by this attacher, natively or through
+		// in-tree migration. Nothing to do.
+		return
+	}
+
+	node, err := h.nodeLister.Get(va.Spec.NodeName)
+	if err != nil {
+		h.saveAttachError(va, err)
+		return
+	}
+
+	if _, err := h.addPVFinalizer(pv); err != nil {
+		h.saveAttachError(va, fmt.Errorf("could not add PersistentVolume finalizer: %s", err))
+		return
+	}
+
+	secrets, err := resolveControllerPublishSecret(pv, h.secretLister, csiSource.ControllerPublishSecretRef)
+	if err != nil {
+		h.saveAttachError(va, err)
+		return
+	}
+
+	if h.limiter != nil {
+		if err := h.limiter.Acquire(context.TODO(), node.Name); err != nil {
+			h.saveAttachError(va, err)
+			return
+		}
+		defer h.limiter.Release(node.Name)
+	}
+
+	// If a prior sync got this far and crashed (or lost its write) before
+	// reaching markAttached below, va.Status.AttachmentMetadata is already
+	// populated even though Attached is still false. Re-issuing
+	// ControllerPublishVolume here is deliberate, not wasted work: the CSI
+	// spec requires the driver to treat this as a no-op for an
+	// already-published volume and return the same publish context, which
+	// is how this confirms the earlier attach rather than trusting the
+	// stored metadata blindly.
+	metadata, err := h.csiConnection.Attach(context.TODO(), csiSource.VolumeHandle, csiSource.ReadOnly, node.Name, csiSource.VolumeAttributes, secrets)
+	if err != nil {
+		h.saveAttachError(va, err)
+		return
+	}
+
+	// Save the publish context before flipping Attached so a crash between
+	// these two writes leaves an unambiguous signal behind: AttachmentMetadata
+	// set with Attached still false means the next sync must replay the
+	// confirm-attach above rather than assume nothing happened yet. When the
+	// driver returns no publish context there is nothing worth splitting the
+	// write for, so this falls through to a single combined update.
+	if len(metadata) > 0 {
+		va, err = h.saveAttachmentMetadata(va, metadata)
+		if err != nil {
+			h.saveAttachError(va, err)
+			return
+		}
+	}
+
+	h.markAttached(va, metadata)
+}
+
+func (h *csiHandler) syncDetach(va *storagev1.VolumeAttachment) {
+	if !hasFinalizer(va.Finalizers, h.finalizerName()) {
+		// Already fully detached and cleaned up.
+		return
+	}
+
+	pv, err := h.getPV(va)
+	if err != nil {
+		h.saveDetachError(va, err)
+		return
+	}
+
+	csiSource, err := h.csiSourceForPV(pv)
+	if err != nil {
+		h.saveDetachError(va, err)
+		return
+	}
+
+	if csiSource != nil {
+		node, err := h.nodeLister.Get(va.Spec.NodeName)
+		if err != nil {
+			h.saveDetachError(va, err)
+			return
+		}
+
+		secrets, err := resolveControllerPublishSecret(pv, h.secretLister, csiSource.ControllerPublishSecretRef)
+		if err != nil {
+			h.saveDetachError(va, err)
+			return
+		}
+
+		if h.limiter != nil {
+			if err := h.limiter.Acquire(context.TODO(), node.Name); err != nil {
+				h.saveDetachError(va, err)
+				return
+			}
+			defer h.limiter.Release(node.Name)
+		}
+
+		// Unlike ControllerPublishVolume, ControllerUnpublishVolume takes no
+		// publish context: connection.CSIConnection.Detach's arguments are
+		// exactly what was passed here, so a retry after a crash already
+		// sends identical arguments with no extra state to persist. There is
+		// deliberately no Status.DetachmentMetadata to match
+		// Status.AttachmentMetadata above; VolumeAttachmentStatus is defined
+		// upstream in k8s.io/api/storage/v1, which this repo does not vendor
+		// and cannot extend with a new field.
+		if err := h.csiConnection.Detach(context.TODO(), csiSource.VolumeHandle, node.Name, secrets); err != nil {
+			h.saveDetachError(va, err)
+			return
+		}
+	}
+
+	if err := h.markAsDetached(va); err != nil {
+		h.saveDetachError(va, fmt.Errorf("could not mark as detached: %s", err))
+	}
+}
+
+func (h *csiHandler) SyncNewOrUpdatedPersistentVolume(pv *v1.PersistentVolume) {
+	h.tryRemovePVFinalizer(pv)
+}
+
+func (h *csiHandler) DeleteVolumeAttachment(va *storagev1.VolumeAttachment) {
+	if va.Spec.Source.PersistentVolumeName == nil {
+		return
+	}
+	pv, err := h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+	if err != nil {
+		return
+	}
+	h.tryRemovePVFinalizer(pv)
+}
+
+// tryRemovePVFinalizer removes this attacher's finalizer from pv once it is
+// marked for deletion and no VolumeAttachment still references it.
+func (h *csiHandler) tryRemovePVFinalizer(pv *v1.PersistentVolume) {
+	if pv.DeletionTimestamp == nil {
+		return
+	}
+	if !hasFinalizer(pv.Finalizers, h.finalizerName()) {
+		return
+	}
+
+	vas, err := h.vaLister.List(labels.Everything())
+	if err != nil {
+		return
+	}
+	for _, va := range vas {
+		if va.Spec.Attacher == h.attacherName && va.Spec.Source.PersistentVolumeName != nil && *va.Spec.Source.PersistentVolumeName == pv.Name {
+			return
+		}
+	}
+
+	newPV := pv.DeepCopy()
+	newPV.Finalizers = removeFinalizer(newPV.Finalizers, h.finalizerName())
+	h.removePVFinalizerWithRetries(newPV)
+}
+
+func (h *csiHandler) getPV(va *storagev1.VolumeAttachment) (*v1.PersistentVolume, error) {
+	if va.Spec.Source.PersistentVolumeName == nil || *va.Spec.Source.PersistentVolumeName == "" {
+		return nil, fmt.Errorf("VolumeAttachment.spec.persistentVolumeName is empty")
+	}
+	return h.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+}
+
+// csiSourceForPV returns the CSIPersistentVolumeSource this attacher should
+// use for pv, translating an in-tree volume source if a registered migration
+// plugin handles it and h.migrationEnabled gates this attacher's migration
+// on. It returns (nil, nil) if pv is not handled by this attacher at all.
+func (h *csiHandler) csiSourceForPV(pv *v1.PersistentVolume) (*v1.CSIPersistentVolumeSource, error) {
+	if pv.Spec.CSI != nil {
+		if pv.Spec.CSI.Driver != h.attacherName {
+			return nil, nil
+		}
+		return pv.Spec.CSI, nil
+	}
+
+	if !h.migrationEnabled {
+		// In-tree translation is disabled for this driver; leave the PV for
+		// the in-tree attach/detach path to handle instead.
+		return nil, nil
+	}
+
+	csiSource, driverName, err := translateInTreePVToCSI(pv)
+	if err != nil {
+		return nil, err
+	}
+	if csiSource == nil || driverName != h.attacherName {
+		return nil, nil
+	}
+	return csiSource, nil
+}
+
+func (h *csiHandler) addVAFinalizer(va *storagev1.VolumeAttachment) (*storagev1.VolumeAttachment, error) {
+	if hasFinalizer(va.Finalizers, h.finalizerName()) {
+		return va, nil
+	}
+
+	newVA := va.DeepCopy()
+	newVA.Finalizers = append(newVA.Finalizers, h.finalizerName())
+	updated, err := h.updateVA(newVA)
+	if err != nil {
+		// updateVA echoes back the attempted write on failure, but that write
+		// never made it to the API server: report the finalizer as absent
+		// rather than handing callers a va that claims otherwise.
+		return va, err
+	}
+	return updated, nil
+}
+
+func (h *csiHandler) addPVFinalizer(pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	if hasFinalizer(pv.Finalizers, h.finalizerName()) {
+		return pv, nil
+	}
+
+	newPV := pv.DeepCopy()
+	newPV.Finalizers = append(newPV.Finalizers, h.finalizerName())
+	return h.updatePV(newPV)
+}
+
+// saveAttachmentMetadata persists the CSI driver's publish context ahead of
+// marking va attached, so that Status.AttachmentMetadata being set while
+// Status.Attached is still false unambiguously means the prior sync reached
+// here and crashed (or lost its write) before markAttached ran.
+func (h *csiHandler) saveAttachmentMetadata(va *storagev1.VolumeAttachment, metadata map[string]string) (*storagev1.VolumeAttachment, error) {
+	newVA := va.DeepCopy()
+	newVA.Status.AttachError = nil
+	if metadata != nil {
+		newVA.Status.AttachmentMetadata = metadata
+	}
+	return h.updateVA(newVA)
+}
+
+// markAttached flips va to Attached=true, persisting metadata alongside it if
+// it was not already saved by a prior call to saveAttachmentMetadata.
+func (h *csiHandler) markAttached(va *storagev1.VolumeAttachment, metadata map[string]string) {
+	newVA := va.DeepCopy()
+	newVA.Status.Attached = true
+	newVA.Status.AttachError = nil
+	if metadata != nil {
+		newVA.Status.AttachmentMetadata = metadata
+	}
+	h.updateVA(newVA)
+}
+
+func (h *csiHandler) markAsDetached(va *storagev1.VolumeAttachment) error {
+	newVA := va.DeepCopy()
+	newVA.Status.Attached = false
+	newVA.Status.DetachError = nil
+	newVA.Finalizers = removeFinalizer(newVA.Finalizers, h.finalizerName())
+	_, err := h.updateVA(newVA)
+	return err
+}
+
+func (h *csiHandler) saveAttachError(va *storagev1.VolumeAttachment, err error) {
+	if va.Status.AttachError != nil && va.Status.AttachError.Message == err.Error() {
+		// Already recorded, don't keep re-saving the same error.
+		return
+	}
+	newVA := va.DeepCopy()
+	newVA.Status.AttachError = &storagev1.VolumeError{Message: err.Error()}
+	h.updateVA(newVA)
+}
+
+func (h *csiHandler) saveDetachError(va *storagev1.VolumeAttachment, err error) {
+	if va.Status.DetachError != nil && va.Status.DetachError.Message == err.Error() {
+		// Already recorded, don't keep re-saving the same error.
+		return
+	}
+	newVA := va.DeepCopy()
+	newVA.Status.DetachError = &storagev1.VolumeError{Message: err.Error()}
+	h.updateVA(newVA)
+}
+
+// updateVA saves va. Failures are left for the next reconcile, triggered by
+// the controller's own watch on the object it just tried to update. A
+// successful write is assumed into vaCache so that a sync running before our
+// own informer has caught up still sees it.
+func (h *csiHandler) updateVA(va *storagev1.VolumeAttachment) (*storagev1.VolumeAttachment, error) {
+	updated, err := h.client.StorageV1().VolumeAttachments().Update(context.TODO(), va, metav1.UpdateOptions{})
+	if err != nil {
+		h.vaCache.Restore(va.Name)
+		return va, err
+	}
+	h.vaCache.Assume(updated)
+	return updated, nil
+}
+
+// updatePV saves pv. Failures are left for the next reconcile.
+func (h *csiHandler) updatePV(pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	return h.client.CoreV1().PersistentVolumes().Update(context.TODO(), pv, metav1.UpdateOptions{})
+}
+
+// removePVFinalizerWithRetries saves pv's finalizer list, retrying a bounded
+// number of times. Unlike updatePV, there is no VolumeAttachment left to
+// record a failure on at this point, so this retries client-side instead of
+// relying on a future reconcile.
+func (h *csiHandler) removePVFinalizerWithRetries(pv *v1.PersistentVolume) error {
+	var lastErr error
+	for i := 0; i < 5; i++ {
+		_, err := h.updatePV(pv)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func hasFinalizer(finalizers []string, name string) bool {
+	for _, f := range finalizers {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(finalizers []string, name string) []string {
+	var newFinalizers []string
+	for _, f := range finalizers {
+		if f != name {
+			newFinalizers = append(newFinalizers, f)
+		}
+	}
+	return newFinalizers
+}
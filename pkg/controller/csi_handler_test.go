@@ -17,11 +17,16 @@ limitations under the License.
 package controller
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kubernetes-csi/external-attacher-csi/pkg/connection"
+	"github.com/kubernetes-csi/external-attacher-csi/pkg/controller/attachlimiter"
 
 	"k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
@@ -31,6 +36,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
 )
 
@@ -41,7 +47,10 @@ func csiHandlerFactory(client kubernetes.Interface, informerFactory informers.Sh
 		csi,
 		informerFactory.Core().V1().PersistentVolumes().Lister(),
 		informerFactory.Core().V1().Nodes().Lister(),
-		informerFactory.Storage().V1().VolumeAttachments().Lister())
+		informerFactory.Storage().V1().VolumeAttachments().Lister(),
+		informerFactory.Core().V1().Secrets().Lister(),
+		nil,
+		true)
 }
 
 func pv() *v1.PersistentVolume {
@@ -203,12 +212,32 @@ func TestCSIHandler(t *testing.T) {
 			expectedActions: []core.Action{
 				// Finalizer is saved first
 				core.NewUpdateAction(vaGroupResourceVersion, metav1.NamespaceNone, va(false /*attached*/, "attacher-csi/test")),
+				// Publish context is saved before Attached flips to true
+				core.NewUpdateAction(vaGroupResourceVersion, metav1.NamespaceNone, vaWithMetadata(va(false, "attacher-csi/test"), map[string]string{"foo": "bar"})),
 				core.NewUpdateAction(vaGroupResourceVersion, metav1.NamespaceNone, vaWithMetadata(va(true, "attacher-csi/test"), map[string]string{"foo": "bar"})),
 			},
 			expectedCSICalls: []csiCall{
 				{"attach", testPVName, testNodeName, nil, map[string]string{"foo": "bar"}},
 			},
 		},
+		{
+			name: "VolumeAttachment with metadata saved but Attached not yet saved -> replays ControllerPublishVolume and confirms attach",
+			// Simulates a controller crash between saveAttachmentMetadata and
+			// markAttached: the object on the API server already carries last
+			// sync's publish context, but Attached is still false.
+			initialObjects: []runtime.Object{pvWithFinalizer(), node()},
+			updatedVA:      vaWithMetadata(va(false, "attacher-csi/test"), map[string]string{"foo": "bar"}),
+			expectedActions: []core.Action{
+				core.NewUpdateAction(vaGroupResourceVersion, metav1.NamespaceNone, vaWithMetadata(va(false, "attacher-csi/test"), map[string]string{"foo": "bar"})),
+				core.NewUpdateAction(vaGroupResourceVersion, metav1.NamespaceNone, vaWithMetadata(va(true, "attacher-csi/test"), map[string]string{"foo": "bar"})),
+			},
+			expectedCSICalls: []csiCall{
+				// The driver is called again with the exact same arguments as
+				// the original attach, confirming idempotency instead of the
+				// controller trusting the stored metadata blindly.
+				{"attach", testPVName, testNodeName, nil, map[string]string{"foo": "bar"}},
+			},
+		},
 		{
 			name:            "unknown driver -> ignored",
 			initialObjects:  []runtime.Object{pvWithFinalizer(), node()},
@@ -547,3 +576,469 @@ func TestCSIHandler(t *testing.T) {
 
 	runTests(t, csiHandlerFactory, tests)
 }
+
+// TestCSIHandlerSecrets exercises ControllerPublishSecretRef template
+// resolution and the Secret lookup it feeds into Attach/Detach.
+func TestCSIHandlerSecrets(t *testing.T) {
+	newHandler := func(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, csi connection.CSIConnection) Handler {
+		return NewCSIHandler(
+			client,
+			testAttacherName,
+			csi,
+			informerFactory.Core().V1().PersistentVolumes().Lister(),
+			informerFactory.Core().V1().Nodes().Lister(),
+			informerFactory.Storage().V1().VolumeAttachments().Lister(),
+			informerFactory.Core().V1().Secrets().Lister(),
+			nil,
+			true)
+	}
+
+	pvWithSecretRef := func(ref *v1.SecretReference, hasClaimRef bool) *v1.PersistentVolume {
+		p := pv()
+		p.Spec.CSI.ControllerPublishSecretRef = ref
+		if hasClaimRef {
+			p.Spec.ClaimRef = &v1.ObjectReference{Name: "claim1", Namespace: "ns1"}
+		}
+		return p
+	}
+
+	secret := func(name, namespace string, data map[string]string) *v1.Secret {
+		bytes := map[string][]byte{}
+		for k, v := range data {
+			bytes[k] = []byte(v)
+		}
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Data:       bytes,
+		}
+	}
+
+	t.Run("secret fetched and passed through on attach", func(t *testing.T) {
+		ref := &v1.SecretReference{Name: "secret-${pv.name}", Namespace: "${pvc.namespace}"}
+		initialPV := pvWithFinalizer()
+		initialPV.Spec.CSI.ControllerPublishSecretRef = ref
+		initialPV.Spec.ClaimRef = &v1.ObjectReference{Name: "claim1", Namespace: "ns1"}
+		s := secret("secret-"+testPVName, "ns1", map[string]string{"token": "v1"})
+
+		client := fake.NewSimpleClientset(initialPV, node(), s, va(false, "attacher-csi/test"))
+		informerFactory := informers.NewSharedInformerFactory(client, 0)
+		informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(initialPV)
+		informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node())
+		informerFactory.Core().V1().Secrets().Informer().GetStore().Add(s)
+
+		csi := &fakeCSIConnection{t: t, calls: []csiCall{{"attach", testPVName, testNodeName, nil, nil}}}
+		ctrl := newHandler(client, informerFactory, csi)
+		ctrl.SyncNewOrUpdatedVolumeAttachment(va(false, "attacher-csi/test"))
+
+		if len(csi.secrets) != 1 || csi.secrets[0]["token"] != "v1" {
+			t.Errorf("expected secret {token: v1} passed to Attach, got %+v", csi.secrets)
+		}
+	})
+
+	t.Run("missing secret -> AttachError", func(t *testing.T) {
+		ref := &v1.SecretReference{Name: "does-not-exist", Namespace: "ns1"}
+		initialPV := pvWithFinalizer()
+		initialPV.Spec.CSI.ControllerPublishSecretRef = ref
+
+		client := fake.NewSimpleClientset(initialPV, node(), va(false, "attacher-csi/test"))
+		informerFactory := informers.NewSharedInformerFactory(client, 0)
+		informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(initialPV)
+		informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node())
+
+		csi := &fakeCSIConnection{t: t}
+		ctrl := newHandler(client, informerFactory, csi)
+		ctrl.SyncNewOrUpdatedVolumeAttachment(va(false, "attacher-csi/test"))
+
+		updated, err := client.StorageV1().VolumeAttachments().Get(context.TODO(), va(false, "").Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get VolumeAttachment: %s", err)
+		}
+		if updated.Status.AttachError == nil {
+			t.Errorf("expected AttachError to be set when the secret is missing")
+		}
+		if csi.index != 0 {
+			t.Errorf("expected no CSI calls, got %d", csi.index)
+		}
+	})
+
+	t.Run("secret change between attach and detach still uses the detach-time value", func(t *testing.T) {
+		ref := &v1.SecretReference{Name: "secret-${pv.name}", Namespace: "ns1"}
+		initialPV := pvWithFinalizer()
+		initialPV.Spec.CSI.ControllerPublishSecretRef = ref
+		s := secret("secret-"+testPVName, "ns1", map[string]string{"token": "v1"})
+
+		client := fake.NewSimpleClientset(initialPV, node(), s, va(false, "attacher-csi/test"))
+		informerFactory := informers.NewSharedInformerFactory(client, 0)
+		informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(initialPV)
+		informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node())
+		informerFactory.Core().V1().Secrets().Informer().GetStore().Add(s)
+
+		csi := &fakeCSIConnection{t: t, calls: []csiCall{
+			{"attach", testPVName, testNodeName, nil, nil},
+			{"detach", testPVName, testNodeName, nil, nil},
+		}}
+		ctrl := newHandler(client, informerFactory, csi)
+
+		ctrl.SyncNewOrUpdatedVolumeAttachment(va(false, "attacher-csi/test"))
+
+		// The Secret's content changes after the volume is attached.
+		s.Data["token"] = []byte("v2")
+		informerFactory.Core().V1().Secrets().Informer().GetStore().Update(s)
+		client.CoreV1().Secrets("ns1").Update(context.TODO(), s, metav1.UpdateOptions{})
+
+		ctrl.SyncNewOrUpdatedVolumeAttachment(deleted(va(true, "attacher-csi/test")))
+
+		if len(csi.secrets) != 2 {
+			t.Fatalf("expected 2 CSI calls to have recorded secrets, got %d", len(csi.secrets))
+		}
+		if csi.secrets[0]["token"] != "v1" {
+			t.Errorf("expected attach to use the attach-time secret value v1, got %v", csi.secrets[0])
+		}
+		if csi.secrets[1]["token"] != "v2" {
+			t.Errorf("expected detach to use the detach-time secret value v2, got %v", csi.secrets[1])
+		}
+	})
+
+	t.Run("templates that fail to resolve", func(t *testing.T) {
+		ref := &v1.SecretReference{Name: "secret-${pv.name}", Namespace: "${pvc.namespace}"}
+		initialPV := pvWithSecretRef(ref, false /* no ClaimRef, so ${pvc.namespace} cannot resolve */)
+		initialPV.Finalizers = []string{"attacher-csi/test"}
+
+		client := fake.NewSimpleClientset(initialPV, node(), va(false, "attacher-csi/test"))
+		informerFactory := informers.NewSharedInformerFactory(client, 0)
+		informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(initialPV)
+		informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node())
+
+		csi := &fakeCSIConnection{t: t}
+		ctrl := newHandler(client, informerFactory, csi)
+		ctrl.SyncNewOrUpdatedVolumeAttachment(va(false, "attacher-csi/test"))
+
+		updated, err := client.StorageV1().VolumeAttachments().Get(context.TODO(), va(false, "").Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get VolumeAttachment: %s", err)
+		}
+		if updated.Status.AttachError == nil {
+			t.Errorf("expected AttachError to be set when the secret template cannot be resolved")
+		}
+		if csi.index != 0 {
+			t.Errorf("expected no CSI calls, got %d", csi.index)
+		}
+	})
+}
+
+// TestCSIHandlerMigration exercises the in-tree -> CSI translation path: the
+// attacher is named after a migrated plugin's CSI driver, and PVs may carry
+// either the in-tree source being migrated or a native CSI source for the
+// same driver.
+func TestCSIHandlerMigration(t *testing.T) {
+	finalizerName := "attacher-" + gcePDCSIDriverName
+
+	newMigrationVA := func(pvName, attacher string) *storagev1.VolumeAttachment {
+		name := pvName
+		return &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       pvName + "-" + testNodeName,
+				Finalizers: []string{finalizerName},
+			},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: attacher,
+				NodeName: testNodeName,
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &name},
+			},
+		}
+	}
+
+	gcePV := func(name string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Finalizers: []string{finalizerName}},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "gce-" + name},
+				},
+			},
+		}
+	}
+
+	nativeCSIPV := func(name string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Finalizers: []string{finalizerName}},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: gcePDCSIDriverName, VolumeHandle: "native-handle"},
+				},
+			},
+		}
+	}
+
+	unsupportedPV := func(name string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Finalizers: []string{finalizerName}},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					FlexVolume: &v1.FlexPersistentVolumeSource{Driver: "example/unsupported"},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name             string
+		pv               *v1.PersistentVolume
+		va               *storagev1.VolumeAttachment
+		migrationEnabled bool
+		expectedCSICalls []csiCall
+		expectAttached   bool
+	}{
+		{
+			name:             "migrated in-tree PV -> attach issued to CSI with translated handle",
+			pv:               gcePV("migrated-pv"),
+			va:               newMigrationVA("migrated-pv", gcePDCSIDriverName),
+			migrationEnabled: true,
+			expectedCSICalls: []csiCall{
+				{"attach", "gce-migrated-pv", testNodeName, nil, nil},
+			},
+			expectAttached: true,
+		},
+		{
+			name:             "unknown in-tree type -> ignored",
+			pv:               unsupportedPV("unsupported-pv"),
+			va:               newMigrationVA("unsupported-pv", gcePDCSIDriverName),
+			migrationEnabled: true,
+			expectAttached:   false,
+		},
+		{
+			name:             "native CSI PV for the same attacher -> attach issued with its own handle",
+			pv:               nativeCSIPV("native-pv"),
+			va:               newMigrationVA("native-pv", gcePDCSIDriverName),
+			migrationEnabled: true,
+			expectedCSICalls: []csiCall{
+				{"attach", "native-handle", testNodeName, nil, nil},
+			},
+			expectAttached: true,
+		},
+		{
+			name:             "migration feature gate disabled -> in-tree PV left untranslated",
+			pv:               gcePV("migrated-pv"),
+			va:               newMigrationVA("migrated-pv", gcePDCSIDriverName),
+			migrationEnabled: false,
+			expectAttached:   false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName}}
+			client := fake.NewSimpleClientset(tc.pv, node, tc.va)
+
+			informerFactory := informers.NewSharedInformerFactory(client, 0)
+			informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(tc.pv)
+			informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node)
+
+			csi := &fakeCSIConnection{t: t, calls: tc.expectedCSICalls}
+			ctrl := NewCSIHandler(
+				client,
+				gcePDCSIDriverName,
+				csi,
+				informerFactory.Core().V1().PersistentVolumes().Lister(),
+				informerFactory.Core().V1().Nodes().Lister(),
+				informerFactory.Storage().V1().VolumeAttachments().Lister(),
+				informerFactory.Core().V1().Secrets().Lister(),
+				nil,
+				tc.migrationEnabled)
+
+			ctrl.SyncNewOrUpdatedVolumeAttachment(tc.va)
+
+			if csi.index != len(tc.expectedCSICalls) {
+				t.Errorf("expected %d CSI calls, got %d", len(tc.expectedCSICalls), csi.index)
+			}
+
+			updated, err := client.StorageV1().VolumeAttachments().Get(context.TODO(), tc.va.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get VolumeAttachment: %s", err)
+			}
+			if updated.Status.Attached != tc.expectAttached {
+				t.Errorf("expected Attached=%v, got %v", tc.expectAttached, updated.Status.Attached)
+			}
+		})
+	}
+}
+
+// TestCSIHandlerAssumeCache exercises the informer-lag scenario the VA assume
+// cache exists to close: the shared informer redelivers the same
+// VolumeAttachment the handler already attached and wrote back (a stale
+// resourceVersion from before that write), because its own watch has not
+// caught up yet. The handler must serve the cache's newer, already-attached
+// copy instead of redoing the CSI call.
+func TestCSIHandlerAssumeCache(t *testing.T) {
+	staleVA := va(false, "attacher-csi/test")
+	initialPV := pvWithFinalizer()
+
+	client := fake.NewSimpleClientset(initialPV, node(), staleVA)
+
+	// The fake clientset, unlike a real API server, does not assign
+	// resourceVersions on its own. Assign increasing ones here so the
+	// assume cache has something real to compare against.
+	nextRV := 0
+	client.Fake.PrependReactor("update", "volumeattachments", func(action core.Action) (bool, runtime.Object, error) {
+		nextRV++
+		updated := action.(core.UpdateAction).GetObject().(*storagev1.VolumeAttachment)
+		updated.ResourceVersion = strconv.Itoa(nextRV)
+		return false, nil, nil
+	})
+
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(initialPV)
+	informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node())
+
+	csi := &fakeCSIConnection{t: t, calls: []csiCall{
+		{"attach", testPVName, testNodeName, nil, nil},
+	}}
+	ctrl := csiHandlerFactory(client, informerFactory, csi)
+
+	// First sync: attaches and writes Attached=true, which the assume cache
+	// now holds at a newer resourceVersion than staleVA.
+	ctrl.SyncNewOrUpdatedVolumeAttachment(staleVA)
+
+	// Second sync: the work queue redelivers the very same stale object,
+	// as it would if the informer's watch had not caught up yet.
+	ctrl.SyncNewOrUpdatedVolumeAttachment(staleVA)
+
+	if csi.index != 1 {
+		t.Errorf("expected exactly 1 CSI attach call despite the stale redelivery, got %d", csi.index)
+	}
+}
+
+// blockingCSIConnection records how many Attach calls are in flight for each
+// node, tracking the high-water mark, and holds every call open until the
+// test closes proceed. It lets a test drive real concurrency through the
+// handler instead of asserting on a canned call script.
+type blockingCSIConnection struct {
+	proceed chan struct{}
+
+	mu      sync.Mutex
+	current map[string]int
+	maxSeen map[string]int
+}
+
+func newBlockingCSIConnection() *blockingCSIConnection {
+	return &blockingCSIConnection{
+		proceed: make(chan struct{}),
+		current: make(map[string]int),
+		maxSeen: make(map[string]int),
+	}
+}
+
+func (c *blockingCSIConnection) Attach(_ context.Context, _ string, _ bool, nodeID string, _, _ map[string]string) (map[string]string, error) {
+	c.mu.Lock()
+	c.current[nodeID]++
+	if c.current[nodeID] > c.maxSeen[nodeID] {
+		c.maxSeen[nodeID] = c.current[nodeID]
+	}
+	c.mu.Unlock()
+
+	<-c.proceed
+
+	c.mu.Lock()
+	c.current[nodeID]--
+	c.mu.Unlock()
+	return nil, nil
+}
+
+func (c *blockingCSIConnection) Detach(_ context.Context, _ string, nodeID string, _ map[string]string) error {
+	_, err := c.Attach(context.TODO(), "", false, nodeID, nil, nil)
+	return err
+}
+
+// TestCSIHandlerAttachConcurrencyLimit enqueues many attachments against a
+// single node through a real attachlimiter.Limiter and checks that the
+// handler never lets more than the per-node cap run their CSI Attach call
+// concurrently, while still eventually attaching every one of them.
+func TestCSIHandlerAttachConcurrencyLimit(t *testing.T) {
+	const numVAs = 5
+	const maxPerNode = 2
+
+	pvs := make([]runtime.Object, 0, numVAs)
+	vas := make([]*storagev1.VolumeAttachment, 0, numVAs)
+	for i := 0; i < numVAs; i++ {
+		pvName := fmt.Sprintf("pv%d", i)
+		pvs = append(pvs, &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: pvName, Finalizers: []string{"attacher-" + testAttacherName}},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: testAttacherName, VolumeHandle: pvName},
+				},
+			},
+		})
+		name := pvName
+		vas = append(vas, &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: pvName + "-" + testNodeName},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: testAttacherName,
+				NodeName: testNodeName,
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &name},
+			},
+		})
+	}
+
+	initialObjects := append([]runtime.Object{node()}, pvs...)
+	for _, va := range vas {
+		initialObjects = append(initialObjects, va)
+	}
+	client := fake.NewSimpleClientset(initialObjects...)
+
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	for _, obj := range pvs {
+		informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(obj)
+	}
+	informerFactory.Core().V1().Nodes().Informer().GetStore().Add(node())
+
+	csi := newBlockingCSIConnection()
+	limiter := attachlimiter.NewLimiter(maxPerNode, 0)
+	ctrl := NewCSIHandler(
+		client,
+		testAttacherName,
+		csi,
+		informerFactory.Core().V1().PersistentVolumes().Lister(),
+		informerFactory.Core().V1().Nodes().Lister(),
+		informerFactory.Storage().V1().VolumeAttachments().Lister(),
+		informerFactory.Core().V1().Secrets().Lister(),
+		limiter,
+		true)
+
+	var wg sync.WaitGroup
+	for _, va := range vas {
+		va := va
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctrl.SyncNewOrUpdatedVolumeAttachment(va)
+		}()
+	}
+
+	// Give every goroutine a chance to either be running its CSI call or
+	// queued behind the per-node cap before inspecting the high-water mark.
+	time.Sleep(100 * time.Millisecond)
+
+	csi.mu.Lock()
+	maxSeen := csi.maxSeen[testNodeName]
+	csi.mu.Unlock()
+	if maxSeen > maxPerNode {
+		t.Errorf("expected at most %d concurrent Attach calls for %s, saw %d", maxPerNode, testNodeName, maxSeen)
+	}
+	if maxSeen == 0 {
+		t.Fatalf("expected at least one Attach call to have started")
+	}
+
+	close(csi.proceed)
+	wg.Wait()
+
+	for _, va := range vas {
+		updated, err := client.StorageV1().VolumeAttachments().Get(context.TODO(), va.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get VolumeAttachment %s: %s", va.Name, err)
+		}
+		if !updated.Status.Attached {
+			t.Errorf("expected %s to be attached", va.Name)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/kubernetes-csi/external-attacher-csi/pkg/connection"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+const (
+	testAttacherName = "csi/test"
+	testPVName       = "pv1"
+	testVolumeHandle = testPVName
+	testNodeName     = "node1"
+)
+
+// reaction lets a test inject a failure (or other custom behavior) into the
+// fake clientset for a given verb/resource pair.
+type reaction struct {
+	verb     string
+	resource string
+	reactor  func(t *testing.T) core.ReactionFunc
+}
+
+// csiCall is both an expectation ("the controller must issue this CSI call
+// next") and, since fakeCSIConnection consumes the same slice, a script for
+// what the fake driver should return when that call comes in.
+type csiCall struct {
+	method   string
+	pvName   string
+	nodeName string
+	err      error
+	metadata map[string]string
+}
+
+type testCase struct {
+	name           string
+	initialObjects []runtime.Object
+
+	addedVA   *storagev1.VolumeAttachment
+	updatedVA *storagev1.VolumeAttachment
+	deletedVA *storagev1.VolumeAttachment
+	updatedPV *v1.PersistentVolume
+
+	reactors []reaction
+
+	expectedActions  []core.Action
+	expectedCSICalls []csiCall
+}
+
+func va(attached bool, finalizer string) *storagev1.VolumeAttachment {
+	pvName := testPVName
+	va := &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testPVName + "-" + testNodeName,
+		},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: testAttacherName,
+			NodeName: testNodeName,
+			Source: storagev1.VolumeAttachmentSource{
+				PersistentVolumeName: &pvName,
+			},
+		},
+		Status: storagev1.VolumeAttachmentStatus{
+			Attached: attached,
+		},
+	}
+	if finalizer != "" {
+		va.Finalizers = []string{finalizer}
+	}
+	return va
+}
+
+func vaWithAttachError(va *storagev1.VolumeAttachment, msg string) *storagev1.VolumeAttachment {
+	va = va.DeepCopy()
+	va.Status.AttachError = &storagev1.VolumeError{Message: msg}
+	return va
+}
+
+func vaWithDetachError(va *storagev1.VolumeAttachment, msg string) *storagev1.VolumeAttachment {
+	va = va.DeepCopy()
+	va.Status.DetachError = &storagev1.VolumeError{Message: msg}
+	return va
+}
+
+func vaWithMetadata(va *storagev1.VolumeAttachment, metadata map[string]string) *storagev1.VolumeAttachment {
+	va = va.DeepCopy()
+	va.Status.AttachmentMetadata = metadata
+	return va
+}
+
+func vaWithInvalidDriver(va *storagev1.VolumeAttachment) *storagev1.VolumeAttachment {
+	va = va.DeepCopy()
+	va.Spec.Attacher = "unknown.csi.driver"
+	return va
+}
+
+func vaWithNoPVReference(va *storagev1.VolumeAttachment) *storagev1.VolumeAttachment {
+	va = va.DeepCopy()
+	va.Spec.Source.PersistentVolumeName = nil
+	return va
+}
+
+func deleted(va *storagev1.VolumeAttachment) *storagev1.VolumeAttachment {
+	va = va.DeepCopy()
+	va.DeletionTimestamp = &metav1.Time{}
+	return va
+}
+
+// fakeCSIConnection replays the csiCall script it is handed: each call it
+// receives is checked against the next expected entry and returns that
+// entry's canned error/metadata.
+type fakeCSIConnection struct {
+	t     *testing.T
+	calls []csiCall
+	index int
+
+	// secrets records the secrets map passed to every Attach/Detach call, in
+	// order, for tests that care about credential resolution.
+	secrets []map[string]string
+}
+
+func (f *fakeCSIConnection) Attach(_ context.Context, volumeHandle string, _ bool, nodeID string, _, secrets map[string]string) (map[string]string, error) {
+	f.secrets = append(f.secrets, secrets)
+	return f.call("attach", volumeHandle, nodeID)
+}
+
+func (f *fakeCSIConnection) Detach(_ context.Context, volumeHandle string, nodeID string, secrets map[string]string) error {
+	f.secrets = append(f.secrets, secrets)
+	_, err := f.call("detach", volumeHandle, nodeID)
+	return err
+}
+
+func (f *fakeCSIConnection) call(method, volumeHandle, nodeID string) (map[string]string, error) {
+	if f.index >= len(f.calls) {
+		f.t.Errorf("unexpected CSI %s call for node %q", method, nodeID)
+		return nil, nil
+	}
+	expected := f.calls[f.index]
+	f.index++
+	if expected.method != method {
+		f.t.Errorf("expected CSI call %d to be %q, got %q", f.index-1, expected.method, method)
+	}
+	if expected.pvName != volumeHandle {
+		f.t.Errorf("expected CSI call %d to use volume handle %q, got %q", f.index-1, expected.pvName, volumeHandle)
+	}
+	if expected.nodeName != nodeID {
+		f.t.Errorf("expected CSI call %d to target node %q, got %q", f.index-1, expected.nodeName, nodeID)
+	}
+	return expected.metadata, expected.err
+}
+
+func runTests(t *testing.T, factory func(kubernetes.Interface, informers.SharedInformerFactory, connection.CSIConnection) Handler, tests []testCase) {
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(test.initialObjects...)
+			for _, r := range test.reactors {
+				client.Fake.PrependReactor(r.verb, r.resource, r.reactor(t))
+			}
+
+			informerFactory := informers.NewSharedInformerFactory(client, 0)
+			for _, obj := range test.initialObjects {
+				switch o := obj.(type) {
+				case *v1.PersistentVolume:
+					informerFactory.Core().V1().PersistentVolumes().Informer().GetStore().Add(o)
+				case *v1.Node:
+					informerFactory.Core().V1().Nodes().Informer().GetStore().Add(o)
+				case *storagev1.VolumeAttachment:
+					informerFactory.Storage().V1().VolumeAttachments().Informer().GetStore().Add(o)
+				}
+			}
+
+			csi := &fakeCSIConnection{t: t, calls: test.expectedCSICalls}
+			ctrl := factory(client, informerFactory, csi)
+
+			switch {
+			case test.addedVA != nil:
+				seed(client, test.addedVA)
+				syncVA(ctrl, client, test.addedVA)
+			case test.updatedVA != nil:
+				seed(client, test.updatedVA)
+				syncVA(ctrl, client, test.updatedVA)
+			case test.deletedVA != nil:
+				ctrl.DeleteVolumeAttachment(test.deletedVA)
+			case test.updatedPV != nil:
+				seed(client, test.updatedPV)
+				ctrl.SyncNewOrUpdatedPersistentVolume(test.updatedPV)
+			}
+
+			checkActions(t, test.expectedActions, client.Actions())
+			if csi.index != len(test.expectedCSICalls) {
+				t.Errorf("expected %d CSI calls, got %d", len(test.expectedCSICalls), csi.index)
+			}
+		})
+	}
+}
+
+// seed puts an object directly into the fake tracker without generating an
+// API action, mimicking an object that already exists by the time the
+// informer event fires.
+func seed(client *fake.Clientset, obj runtime.Object) {
+	if err := client.Tracker().Add(obj); err != nil {
+		_ = client.Tracker().Update(storagev1.SchemeGroupVersion.WithResource("volumeattachments"), obj, metav1.NamespaceNone)
+	}
+}
+
+// syncVA simulates a controller work queue: it re-invokes the handler with
+// the latest persisted state until a pass produces no new actions.
+func syncVA(ctrl Handler, client *fake.Clientset, va *storagev1.VolumeAttachment) {
+	last := -1
+	for i := 0; i < 10; i++ {
+		ctrl.SyncNewOrUpdatedVolumeAttachment(va)
+		actions := client.Actions()
+		if len(actions) == last {
+			return
+		}
+		last = len(actions)
+
+		obj, err := client.Tracker().Get(storagev1.SchemeGroupVersion.WithResource("volumeattachments"), metav1.NamespaceNone, va.Name)
+		if err != nil {
+			return
+		}
+		va = obj.(*storagev1.VolumeAttachment)
+	}
+}
+
+func checkActions(t *testing.T, expected, actual []core.Action) {
+	for i, action := range actual {
+		if len(expected) < i+1 {
+			t.Errorf("unexpected extra action %d: %+v", i, action)
+			continue
+		}
+		if !reflect.DeepEqual(expected[i], action) {
+			t.Errorf("action %d does not match:\nexpected: %+v\ngot:      %+v", i, expected[i], action)
+		}
+	}
+	if len(actual) < len(expected) {
+		t.Errorf("expected %d actions, got only %d", len(expected), len(actual))
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+)
+
+// gcePDCSIDriverName is the CSI driver that GCE PD migrates to.
+const gcePDCSIDriverName = "pd.csi.storage.gke.io"
+
+func init() {
+	registerInTreePlugin(&gcePersistentDiskPlugin{})
+}
+
+type gcePersistentDiskPlugin struct{}
+
+func (p *gcePersistentDiskPlugin) CanSupport(pv *v1.PersistentVolume) bool {
+	return pv.Spec.GCEPersistentDisk != nil
+}
+
+func (p *gcePersistentDiskPlugin) GetCSIDriverName() string {
+	return gcePDCSIDriverName
+}
+
+func (p *gcePersistentDiskPlugin) TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.CSIPersistentVolumeSource, error) {
+	pd := pv.Spec.GCEPersistentDisk
+	if pd == nil {
+		return nil, fmt.Errorf("PersistentVolume %q does not have a GCEPersistentDisk source", pv.Name)
+	}
+	if pd.Partition != 0 {
+		return nil, fmt.Errorf("GCEPersistentDisk %q: partitions are not supported by the migrated CSI driver", pd.PDName)
+	}
+
+	return &v1.CSIPersistentVolumeSource{
+		Driver:       gcePDCSIDriverName,
+		VolumeHandle: pd.PDName,
+		ReadOnly:     pd.ReadOnly,
+		FSType:       pd.FSType,
+	}, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+)
+
+// inTreePlugin translates an in-tree PersistentVolumeSource into the
+// CSIPersistentVolumeSource of the CSI driver that has taken over the
+// migration of that in-tree volume plugin.
+type inTreePlugin interface {
+	// CanSupport returns true if pv uses the in-tree volume source this
+	// plugin knows how to translate.
+	CanSupport(pv *v1.PersistentVolume) bool
+
+	// GetCSIDriverName returns the name of the CSI driver that migrated
+	// volumes handled by this plugin are routed to.
+	GetCSIDriverName() string
+
+	// TranslateInTreePVToCSI converts pv's in-tree volume source into the
+	// equivalent CSIPersistentVolumeSource.
+	TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.CSIPersistentVolumeSource, error)
+}
+
+// migrationPlugins holds every in-tree plugin this attacher knows how to
+// translate, registered by their init() functions via registerInTreePlugin.
+var migrationPlugins []inTreePlugin
+
+func registerInTreePlugin(p inTreePlugin) {
+	migrationPlugins = append(migrationPlugins, p)
+}
+
+// translateInTreePVToCSI returns the CSI representation of pv's in-tree
+// volume source and the CSI driver name it has been migrated to, using
+// whichever registered plugin claims pv. It returns (nil, "", nil) if pv's
+// source is not an in-tree type known to any registered plugin.
+func translateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.CSIPersistentVolumeSource, string, error) {
+	for _, p := range migrationPlugins {
+		if !p.CanSupport(pv) {
+			continue
+		}
+		csiSource, err := p.TranslateInTreePVToCSI(pv)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to translate in-tree volume to CSI for PersistentVolume %q: %s", pv.Name, err)
+		}
+		return csiSource, p.GetCSIDriverName(), nil
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// secretAnnotationTemplate matches ${pv.annotations['key']} references in a
+// secret name/namespace template.
+var secretAnnotationTemplate = regexp.MustCompile(`\$\{pv\.annotations\['([^']+)'\]\}`)
+
+// resolveControllerPublishSecret resolves ref's Name/Namespace templates
+// against pv and fetches the referenced Secret, converting it to the
+// map[string]string CSIConnection.Attach/Detach expect. It returns (nil, nil)
+// if ref is nil, i.e. the driver does not require ControllerPublish secrets
+// for this volume.
+func resolveControllerPublishSecret(pv *v1.PersistentVolume, secretLister corelisters.SecretLister, ref *v1.SecretReference) (map[string]string, error) {
+	if ref == nil {
+		return nil, nil
+	}
+
+	name, err := resolveSecretTemplate(pv, ref.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ControllerPublishSecretRef.Name: %s", err)
+	}
+	namespace, err := resolveSecretTemplate(pv, ref.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ControllerPublishSecretRef.Namespace: %s", err)
+	}
+
+	secret, err := secretLister.Secrets(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %s", namespace, name, err)
+	}
+
+	return secretDataToMap(secret), nil
+}
+
+// resolveSecretTemplate expands ${pv.name}, ${pvc.name}, ${pvc.namespace} and
+// ${pv.annotations['...']} references in template against pv.
+func resolveSecretTemplate(pv *v1.PersistentVolume, template string) (string, error) {
+	result := strings.ReplaceAll(template, "${pv.name}", pv.Name)
+
+	if pv.Spec.ClaimRef != nil {
+		result = strings.ReplaceAll(result, "${pvc.name}", pv.Spec.ClaimRef.Name)
+		result = strings.ReplaceAll(result, "${pvc.namespace}", pv.Spec.ClaimRef.Namespace)
+	}
+
+	result = secretAnnotationTemplate.ReplaceAllStringFunc(result, func(match string) string {
+		key := secretAnnotationTemplate.FindStringSubmatch(match)[1]
+		return pv.Annotations[key]
+	})
+
+	if strings.Contains(result, "${") {
+		return "", fmt.Errorf("template %q contains unresolvable references", template)
+	}
+	return result, nil
+}
+
+func secretDataToMap(secret *v1.Secret) map[string]string {
+	data := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	return data
+}